@@ -18,21 +18,32 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/RedHatInsights/insights-results-aggregator/broker"
 	"github.com/RedHatInsights/insights-results-aggregator/consumer"
+	"github.com/RedHatInsights/insights-results-aggregator/metrics"
 	"github.com/RedHatInsights/insights-results-aggregator/producer"
+	"github.com/RedHatInsights/insights-results-aggregator/schema"
 	"github.com/RedHatInsights/insights-results-aggregator/server"
 	"github.com/RedHatInsights/insights-results-aggregator/storage"
 )
 
+// consumerShutdownTimeout bounds how long startConsumer waits for in-flight
+// ProcessMessage calls to finish after a shutdown signal before giving up
+// and closing the consumer anyway
+const consumerShutdownTimeout = 30 * time.Second
+
 const (
 	// ExitStatusOK means that the tool finished with success
 	ExitStatusOK = iota
@@ -69,9 +80,10 @@ func loadConfiguration(defaultConfigFile string) {
 func loadBrokerConfiguration() broker.Configuration {
 	brokerCfg := viper.Sub("broker")
 	return broker.Configuration{
-		Address: brokerCfg.GetString("address"),
-		Topic:   brokerCfg.GetString("topic"),
-		Group:   brokerCfg.GetString("group"),
+		Address:         brokerCfg.GetString("address"),
+		Topic:           brokerCfg.GetString("topic"),
+		Group:           brokerCfg.GetString("group"),
+		DeadLetterTopic: brokerCfg.GetString("dead_letter_topic"),
 	}
 }
 
@@ -91,9 +103,35 @@ func loadServerConfiguration() server.Configuration {
 	}
 }
 
+func loadProcessingConfiguration() schema.Configuration {
+	processingCfg := viper.Sub("processing")
+	return schema.Configuration{
+		SchemaPath: processingCfg.GetString("schema_path"),
+	}
+}
+
+func loadMetricsConfiguration() metrics.Configuration {
+	metricsCfg := viper.Sub("metrics")
+	return metrics.Configuration{
+		Address: metricsCfg.GetString("address"),
+	}
+}
+
+// startMetricsServer starts the Prometheus /metrics admin listener in its
+// own goroutine. A listener failure is logged, not fatal, since it must
+// never take down the consumer or server it is reporting on.
+func startMetricsServer(metricsInstance *metrics.Metrics, address string) {
+	go func() {
+		if err := metricsInstance.Serve(address); err != nil {
+			log.Println("Error serving metrics:", err)
+		}
+	}()
+}
+
 func produceMessages() error {
 	const testMessage = `
-{"OrgID":1,
+{"Version":1,
+ "OrgID":1,
  "ClusterName":"aaaaaaaa-bbbb-cccc-dddd-000000000000",
  "Report":"{}"}
 `
@@ -116,14 +154,47 @@ func startConsumer() error {
 	}
 	defer storage.Close()
 
+	processingCfg := loadProcessingConfiguration()
+	validator, err := schema.New(processingCfg.SchemaPath)
+	if err != nil {
+		log.Fatal(err)
+		return err
+	}
+
+	metricsCfg := loadMetricsConfiguration()
+	metricsInstance := metrics.New()
+	startMetricsServer(metricsInstance, metricsCfg.Address)
+
 	brokerCfg := loadBrokerConfiguration()
-	consumerInstance, err := consumer.New(brokerCfg, storage)
+	consumerInstance, err := consumer.New(brokerCfg, storage, metricsInstance, validator)
 	if err != nil {
 		log.Fatal(err)
 		return err
 	}
 	defer consumerInstance.Close()
-	err = consumerInstance.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- consumerInstance.Start(ctx)
+	}()
+
+	select {
+	case sig := <-signals:
+		log.Printf("Received signal %v, draining in-flight messages before shutdown\n", sig)
+		cancel()
+		select {
+		case err = <-done:
+		case <-time.After(consumerShutdownTimeout):
+			log.Println("Timed out waiting for consumer to drain in-flight messages")
+		}
+	case err = <-done:
+	}
 	if err != nil {
 		log.Fatal(err)
 		return err
@@ -140,8 +211,12 @@ func startServer() error {
 	}
 	defer storage.Close()
 
+	metricsCfg := loadMetricsConfiguration()
+	metricsInstance := metrics.New()
+	startMetricsServer(metricsInstance, metricsCfg.Address)
+
 	serverCfg := loadServerConfiguration()
-	serverInstance := server.New(serverCfg, storage)
+	serverInstance := server.New(serverCfg, storage, metricsInstance)
 	err = serverInstance.Start()
 	if err != nil {
 		log.Fatal(err)
@@ -17,121 +17,427 @@ limitations under the License.
 package consumer
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"github.com/Shopify/sarama"
 	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
 
 	"github.com/RedHatInsights/insights-results-aggregator/broker"
+	"github.com/RedHatInsights/insights-results-aggregator/metrics"
+	"github.com/RedHatInsights/insights-results-aggregator/schema"
 	"github.com/RedHatInsights/insights-results-aggregator/storage"
 	"github.com/RedHatInsights/insights-results-aggregator/types"
 )
 
 // Consumer represents any consumer of insights-rules messages
 type Consumer interface {
-	Start() error
+	Start(ctx context.Context) error
 	Close() error
 	ProcessMessage(msg *sarama.ConsumerMessage) error
 }
 
-// Impl in an implementation of Consumer interface
+// maxDeliveryAttempts bounds how many times a message that keeps failing
+// with a retryable storage error is redelivered before it is given up on
+// and routed to the dead letter topic instead
+const maxDeliveryAttempts = 5
+
+// minRetryDelay and maxRetryDelay bound the exponential backoff ConsumeClaim
+// applies between retries of the same message after a retryable storage
+// error
+const (
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// backoffDelay returns how long to wait before the next delivery attempt,
+// doubling with each prior attempt and capped at maxRetryDelay
+func backoffDelay(priorAttempts int) time.Duration {
+	delay := minRetryDelay << priorAttempts
+	if delay > maxRetryDelay || delay <= 0 {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// Impl in an implementation of Consumer interface backed by a Kafka consumer
+// group. Offsets are only marked once the corresponding message has been
+// durably written to storage or routed to the dead letter topic, so a crash
+// between consumption and the write replays the message on the next
+// rebalance instead of losing it.
 type Impl struct {
-	Configuration     broker.Configuration
-	Consumer          sarama.Consumer
-	PartitionConsumer sarama.PartitionConsumer
-	Storage           storage.Storage
+	Configuration broker.Configuration
+	ConsumerGroup sarama.ConsumerGroup
+	Storage       storage.Storage
+	// Producer publishes unprocessable messages to the dead letter topic.
+	// It is nil when Configuration.DeadLetterTopic is not set.
+	Producer sarama.SyncProducer
+	// Metrics holds the Prometheus collectors this consumer reports to
+	Metrics *metrics.Metrics
+	// Validator checks incoming messages against the configured envelope
+	// schema before they are trusted. It is nil when no schema is
+	// configured, in which case messages are only checked for the
+	// presence of their top-level fields.
+	Validator *schema.Validator
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	retryMu     sync.Mutex
+	retryCounts map[string]int
+
+	parseFailures    int64
+	dltPublishes     int64
+	successfulWrites int64
 }
 
 type incomingMessage struct {
+	Version      *int                 `json:"Version"`
 	Organization *types.OrgID         `json:"OrgID"`
 	ClusterName  *types.ClusterName   `json:"ClusterName"`
 	Report       *types.ClusterReport `json:"Report"`
 }
 
 // New constructs new implementation of Consumer interface
-func New(brokerCfg broker.Configuration, storage storage.Storage) (Consumer, error) {
-	c, err := sarama.NewConsumer([]string{brokerCfg.Address}, nil)
-	if err != nil {
-		return nil, err
-	}
+func New(
+	brokerCfg broker.Configuration,
+	storage storage.Storage,
+	metrics *metrics.Metrics,
+	validator *schema.Validator,
+) (Consumer, error) {
+	config := sarama.NewConfig()
+	// commits are issued explicitly, right after a message has been
+	// written to storage, never on a timer
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	// resume from the committed offset; if the group has never committed
+	// one for this partition (e.g. first run), start from the oldest
+	// available message rather than skipping straight to the tail
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
 
-	partitions, err := c.Partitions(brokerCfg.Topic)
+	consumerGroup, err := sarama.NewConsumerGroup([]string{brokerCfg.Address}, brokerCfg.Group, config)
 	if err != nil {
 		return nil, err
 	}
 
-	partitionConsumer, err := c.ConsumePartition(brokerCfg.Topic, partitions[0], sarama.OffsetNewest)
-	if err != nil {
-		return nil, err
+	var producer sarama.SyncProducer
+	if brokerCfg.DeadLetterTopic != "" {
+		producerConfig := sarama.NewConfig()
+		producerConfig.Producer.Return.Successes = true
+		producer, err = sarama.NewSyncProducer([]string{brokerCfg.Address}, producerConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	consumer := Impl{
-		Configuration:     brokerCfg,
-		Consumer:          c,
-		PartitionConsumer: partitionConsumer,
-		Storage:           storage,
+	consumer := &Impl{
+		Configuration: brokerCfg,
+		ConsumerGroup: consumerGroup,
+		Storage:       storage,
+		Producer:      producer,
+		Metrics:       metrics,
+		Validator:     validator,
+		retryCounts:   map[string]int{},
 	}
 	return consumer, nil
 }
 
-func parseMessage(messageValue []byte) (types.OrgID, types.ClusterName, types.ClusterReport, error) {
+func parseMessage(validator *schema.Validator, messageValue []byte) (int, types.OrgID, types.ClusterName, types.ClusterReport, error) {
+	if validator != nil {
+		if err := validator.Validate(messageValue); err != nil {
+			return 0, 0, "", "", err
+		}
+	}
+
 	var deserialized incomingMessage
 
 	err := json.Unmarshal(messageValue, &deserialized)
 	if err != nil {
-		return 0, "", "", err
+		return 0, 0, "", "", err
 	}
 
+	if deserialized.Version == nil {
+		return 0, 0, "", "", errors.New("Missing required attribute 'Version'")
+	}
 	if deserialized.Organization == nil {
-		return 0, "", "", errors.New("Missing required attribute 'OrgID'")
+		return 0, 0, "", "", errors.New("Missing required attribute 'OrgID'")
 	}
 	if deserialized.ClusterName == nil {
-		return 0, "", "", errors.New("Missing required attribute 'ClusterName'")
+		return 0, 0, "", "", errors.New("Missing required attribute 'ClusterName'")
 	}
 	if deserialized.Report == nil {
-		return 0, "", "", errors.New("Missing required attribute 'Report'")
+		return 0, 0, "", "", errors.New("Missing required attribute 'Report'")
 	}
-	return *deserialized.Organization, *deserialized.ClusterName, *deserialized.Report, nil
+	return *deserialized.Version, *deserialized.Organization, *deserialized.ClusterName, *deserialized.Report, nil
 }
 
-// Start starts consumer
-func (consumer Impl) Start() error {
+// Start starts consumer and blocks until ctx is cancelled or the consumer
+// group session is cancelled via Close, whichever happens first
+func (consumer *Impl) Start(ctx context.Context) error {
 	log.Printf("Consumer has been started, waiting for messages send to topic %s\n", consumer.Configuration.Topic)
-	consumed := 0
-	for {
-		msg := <-consumer.PartitionConsumer.Messages()
-		err := consumer.ProcessMessage(msg)
-		if err != nil {
-			log.Println("Error processing message consumed from Kafka:", err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	consumer.cancel = cancel
+
+	consumer.wg.Add(1)
+	go func() {
+		defer consumer.wg.Done()
+		for {
+			// Consume joins the consumer group, blocks until a
+			// rebalance happens, and returns. It must be called
+			// again in a loop for as long as the session is alive,
+			// each call picking up whatever partitions the group
+			// assigns this member this time around.
+			if err := consumer.ConsumerGroup.Consume(ctx, []string{consumer.Configuration.Topic}, consumer); err != nil {
+				log.Println("Error from consumer group session:", err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
 		}
-		consumed++
-	}
+	}()
+
+	consumer.wg.Wait()
+	return nil
 }
 
-// ProcessMessage processes an incoming message
-func (consumer Impl) ProcessMessage(msg *sarama.ConsumerMessage) error {
+// ProcessMessage processes an incoming message. A nil return means the
+// message has either been stored successfully or routed to the dead letter
+// topic, and its offset can be committed. A non-nil return means the
+// message must not be committed: either the storage error is retryable, or
+// the message could not be routed to the dead letter topic because none is
+// configured or the publish failed.
+func (consumer *Impl) ProcessMessage(msg *sarama.ConsumerMessage) error {
 	log.Printf("Consumed message offset %d\n", msg.Offset)
-	orgID, clusterName, report, err := parseMessage(msg.Value)
-	log.Println(orgID, clusterName, report, err)
+	version, orgID, clusterName, report, err := parseMessage(consumer.Validator, msg.Value)
 	if err != nil {
+		atomic.AddInt64(&consumer.parseFailures, 1)
+		if consumer.Metrics != nil {
+			consumer.Metrics.ParseErrorsTotal.Inc()
+		}
 		log.Println("Error parsing message from Kafka:", err)
-		return err
+		return consumer.deadLetter(msg, err)
 	}
+	log.Println(version, orgID, clusterName, report)
+	if consumer.Metrics != nil {
+		consumer.Metrics.SchemaVersionTotal.WithLabelValues(strconv.Itoa(version)).Inc()
+	}
+
+	writeStart := time.Now()
 	err = consumer.Storage.WriteReportForCluster(orgID, clusterName, report)
+	if consumer.Metrics != nil {
+		consumer.Metrics.StorageWriteDuration.Observe(time.Since(writeStart).Seconds())
+	}
 	if err != nil {
 		log.Println("Error writing report to database:", err)
-		return err
+		if consumer.Metrics != nil {
+			consumer.Metrics.StorageWriteErrorsTotal.Inc()
+		}
+		if isRetryableStorageError(err) {
+			if consumer.attempts(msg) < maxDeliveryAttempts {
+				return err
+			}
+			log.Printf("Giving up on offset %d after %d attempts\n", msg.Offset, maxDeliveryAttempts)
+		}
+		return consumer.deadLetter(msg, err)
 	}
+
+	consumer.forgetAttempts(msg)
+	atomic.AddInt64(&consumer.successfulWrites, 1)
 	// message has been parsed and stored into storage
 	return nil
 }
 
-// Close method closes all resources used by consumer
-func (consumer Impl) Close() error {
-	err := consumer.PartitionConsumer.Close()
-	if err != nil {
+// isRetryableStorageError tells apart transient storage failures (dropped
+// connection, timed out query) -- worth redelivering the message for --
+// from failures that will never succeed no matter how many times the same
+// message is replayed, such as a schema violation or a duplicate primary
+// key.
+func isRetryableStorageError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// attemptKey identifies a message for the purpose of counting delivery
+// attempts across redeliveries of the same offset
+func attemptKey(msg *sarama.ConsumerMessage) string {
+	return strconv.Itoa(int(msg.Partition)) + "/" + strconv.FormatInt(msg.Offset, 10)
+}
+
+func (consumer *Impl) attempts(msg *sarama.ConsumerMessage) int {
+	key := attemptKey(msg)
+	consumer.retryMu.Lock()
+	defer consumer.retryMu.Unlock()
+	consumer.retryCounts[key]++
+	return consumer.retryCounts[key]
+}
+
+// currentAttempts returns how many delivery attempts have been recorded for
+// msg so far, without counting a new one
+func (consumer *Impl) currentAttempts(msg *sarama.ConsumerMessage) int {
+	key := attemptKey(msg)
+	consumer.retryMu.Lock()
+	defer consumer.retryMu.Unlock()
+	return consumer.retryCounts[key]
+}
+
+func (consumer *Impl) forgetAttempts(msg *sarama.ConsumerMessage) {
+	key := attemptKey(msg)
+	consumer.retryMu.Lock()
+	defer consumer.retryMu.Unlock()
+	delete(consumer.retryCounts, key)
+}
+
+// deadLetter publishes the original message to the configured dead letter
+// topic, carrying the failure reason, its original coordinates, and the
+// number of delivery attempts made so far as headers. It returns a non-nil
+// error only when the dead letter topic is not configured or the publish
+// itself fails, in which case the caller must not commit the offset.
+func (consumer *Impl) deadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	if consumer.Producer == nil || consumer.Configuration.DeadLetterTopic == "" {
+		return cause
+	}
+
+	attempts := consumer.currentAttempts(msg)
+	consumer.forgetAttempts(msg)
+
+	producerMessage := &sarama.ProducerMessage{
+		Topic: consumer.Configuration.DeadLetterTopic,
+		Value: sarama.ByteEncoder(msg.Value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("error"), Value: []byte(cause.Error())},
+			{Key: []byte("original-topic"), Value: []byte(msg.Topic)},
+			{Key: []byte("original-partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte("original-offset"), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			{Key: []byte("retry-count"), Value: []byte(strconv.Itoa(attempts))},
+		},
+	}
+
+	if _, _, err := consumer.Producer.SendMessage(producerMessage); err != nil {
+		log.Println("Error publishing message to dead letter topic:", err)
 		return err
 	}
-	err = consumer.Consumer.Close()
-	return err
+	atomic.AddInt64(&consumer.dltPublishes, 1)
+	return nil
+}
+
+// ParseFailures returns the number of messages that could not be parsed
+func (consumer *Impl) ParseFailures() int64 {
+	return atomic.LoadInt64(&consumer.parseFailures)
+}
+
+// DeadLetterPublishes returns the number of messages routed to the dead
+// letter topic
+func (consumer *Impl) DeadLetterPublishes() int64 {
+	return atomic.LoadInt64(&consumer.dltPublishes)
+}
+
+// SuccessfulWrites returns the number of messages successfully written to
+// storage
+func (consumer *Impl) SuccessfulWrites() int64 {
+	return atomic.LoadInt64(&consumer.successfulWrites)
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim
+func (consumer *Impl) Setup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines
+// have exited
+func (consumer *Impl) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim consumes messages from a single partition claim handed to
+// this group member. sarama runs one ConsumeClaim goroutine per claimed
+// partition, so fan-out across partitions falls out of the consumer group
+// itself.
+func (consumer *Impl) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		if consumer.Metrics != nil {
+			consumer.Metrics.ConsumedMessagesTotal.Inc()
+		}
+
+		// A retryable error must never be skipped over: ConsumeClaim
+		// keeps retrying the same message (never moving on to the
+		// next one) until ProcessMessage reports it handled, since
+		// marking a later offset would otherwise commit the
+		// partition past this still-unprocessed one.
+		for {
+			err := consumer.ProcessMessage(msg)
+			if err == nil {
+				break
+			}
+			log.Println("Error processing message consumed from Kafka:", err)
+			select {
+			case <-session.Context().Done():
+				return nil
+			case <-time.After(backoffDelay(consumer.currentAttempts(msg))):
+			}
+		}
+
+		// only advance the offset once the message has been durably
+		// written or dead-lettered, so a crash before this point replays
+		// the message
+		session.MarkMessage(msg, "")
+		// AutoCommit is disabled, so the mark above only updates
+		// sarama's in-memory state; it must be flushed explicitly or
+		// the group's committed offset never advances
+		session.Commit()
+
+		if consumer.Metrics != nil {
+			partition := strconv.Itoa(int(msg.Partition))
+			lag := claim.HighWaterMarkOffset() - msg.Offset - 1
+			if lag < 0 {
+				lag = 0
+			}
+			consumer.Metrics.ConsumerLag.WithLabelValues(partition).Set(float64(lag))
+		}
+	}
+	return nil
+}
+
+// closeWaitTimeout bounds how long Close waits for the ConsumeClaim
+// goroutine to exit before giving up and closing the underlying resources
+// anyway. Without this bound, a ConsumeClaim stuck retrying a message
+// against a storage backend that never recovers would make Close -- and
+// whatever caller is blocked in it, such as a deferred shutdown path --
+// hang forever, defeating any timeout the caller already applied around
+// cancellation.
+const closeWaitTimeout = 10 * time.Second
+
+// Close method closes all resources used by consumer, cancelling the group
+// session and waiting for the ConsumeClaim goroutine to exit, up to
+// closeWaitTimeout, before closing the underlying Kafka clients regardless
+func (consumer *Impl) Close() error {
+	if consumer.cancel != nil {
+		consumer.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		consumer.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeWaitTimeout):
+		log.Println("Timed out waiting for ConsumeClaim to exit; closing Kafka clients anyway")
+	}
+
+	if consumer.Producer != nil {
+		if err := consumer.Producer.Close(); err != nil {
+			return err
+		}
+	}
+	return consumer.ConsumerGroup.Close()
 }
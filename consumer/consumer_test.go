@@ -0,0 +1,145 @@
+/*
+Copyright © 2020 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/RedHatInsights/insights-results-aggregator/types"
+)
+
+// blockingStorage blocks WriteReportForCluster until release is closed, so
+// tests can observe consumer state while a write is still in flight
+type blockingStorage struct {
+	release chan struct{}
+	wrote   chan struct{}
+}
+
+func (storage *blockingStorage) WriteReportForCluster(
+	orgID types.OrgID, clusterName types.ClusterName, report types.ClusterReport,
+) error {
+	<-storage.release
+	close(storage.wrote)
+	return nil
+}
+
+func (storage *blockingStorage) ReadReportForCluster(
+	orgID types.OrgID, clusterName types.ClusterName,
+) (types.ClusterReport, error) {
+	return "", nil
+}
+
+func (storage *blockingStorage) Close() error { return nil }
+
+type fakeClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func (claim *fakeClaim) Topic() string                            { return "test-topic" }
+func (claim *fakeClaim) Partition() int32                         { return 0 }
+func (claim *fakeClaim) InitialOffset() int64                     { return 0 }
+func (claim *fakeClaim) HighWaterMarkOffset() int64               { return 1 }
+func (claim *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return claim.messages }
+
+// fakeSession is a minimal sarama.ConsumerGroupSession that records marked
+// offsets instead of talking to a broker
+type fakeSession struct {
+	ctx    context.Context
+	marked chan int64
+}
+
+func (session *fakeSession) Claims() map[string][]int32 { return nil }
+func (session *fakeSession) MemberID() string           { return "" }
+func (session *fakeSession) GenerationID() int32        { return 0 }
+func (session *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+}
+func (session *fakeSession) Commit() {}
+func (session *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+}
+func (session *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	session.marked <- msg.Offset
+}
+func (session *fakeSession) Context() context.Context { return session.ctx }
+
+// TestConsumeClaimDoesNotCommitInFlightMessageAfterCancel guards against the
+// offset-skipping bug fixed in ConsumeClaim: a message must never be marked
+// while its write is still in flight, whether or not the session has been
+// cancelled in the meantime.
+func TestConsumeClaimDoesNotCommitInFlightMessageAfterCancel(t *testing.T) {
+	storage := &blockingStorage{release: make(chan struct{}), wrote: make(chan struct{})}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"Version":     1,
+		"OrgID":       1,
+		"ClusterName": "aaaaaaaa-bbbb-cccc-dddd-000000000000",
+		"Report":      "{}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+	claim.messages <- &sarama.ConsumerMessage{Value: payload, Offset: 42}
+	close(claim.messages)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &fakeSession{ctx: ctx, marked: make(chan int64, 1)}
+
+	consumer := &Impl{Storage: storage, retryCounts: map[string]int{}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = consumer.ConsumeClaim(session, claim)
+	}()
+
+	select {
+	case <-session.marked:
+		t.Fatal("offset was marked before the in-flight write finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// cancelling while the write is still in flight must not cause the
+	// message to be marked either
+	cancel()
+	select {
+	case <-session.marked:
+		t.Fatal("offset was marked after cancel but before the write finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(storage.release)
+	<-storage.wrote
+
+	select {
+	case offset := <-session.marked:
+		if offset != 42 {
+			t.Fatalf("expected offset 42 to be marked, got %d", offset)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("offset was never marked after the write completed")
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2020 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes the Prometheus collectors tracked by the
+// consumer and server so operators can alert on consumer lag and error
+// rates instead of relying on log.Printf output.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Configuration holds the metrics subpackage's own configuration, loaded
+// from the "metrics" section of the config file
+type Configuration struct {
+	Address string
+}
+
+// Metrics bundles together the collectors published by the service. It is
+// constructed once at startup and threaded into the consumer and server via
+// constructor injection, which also lets tests assert on emitted values
+// without reaching into global package state.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	// ConsumedMessagesTotal counts every message handed to ProcessMessage,
+	// regardless of outcome
+	ConsumedMessagesTotal prometheus.Counter
+	// ParseErrorsTotal counts messages that failed to parse
+	ParseErrorsTotal prometheus.Counter
+	// StorageWriteErrorsTotal counts failed Storage.WriteReportForCluster calls
+	StorageWriteErrorsTotal prometheus.Counter
+	// StorageWriteDuration tracks how long Storage.WriteReportForCluster takes
+	StorageWriteDuration prometheus.Histogram
+	// ConsumerLag tracks HighWaterMarkOffset - lastCommittedOffset per partition
+	ConsumerLag *prometheus.GaugeVec
+	// HTTPRequestDuration tracks request latency labeled by route
+	HTTPRequestDuration *prometheus.HistogramVec
+	// SchemaVersionTotal counts successfully validated messages labeled by
+	// the envelope's Version field, so a rollout of a new schema version
+	// can be tracked
+	SchemaVersionTotal *prometheus.CounterVec
+}
+
+// New creates a Metrics bundle and registers all of its collectors with a
+// fresh prometheus.Registry
+func New() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	metrics := &Metrics{
+		Registry: registry,
+		ConsumedMessagesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "consumed_messages_total",
+			Help: "The total number of messages consumed from Kafka",
+		}),
+		ParseErrorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "parse_errors_total",
+			Help: "The total number of messages that failed to parse",
+		}),
+		StorageWriteErrorsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "storage_write_errors_total",
+			Help: "The total number of failed writes to storage",
+		}),
+		StorageWriteDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "storage_write_duration_seconds",
+			Help: "Time spent writing a report for a cluster to storage",
+		}),
+		ConsumerLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "consumer_lag",
+			Help: "HighWaterMarkOffset minus the last committed offset, per partition",
+		}, []string{"partition"}),
+		HTTPRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "http_request_duration_seconds",
+			Help: "Time spent serving an HTTP request, labeled by route",
+		}, []string{"route"}),
+		SchemaVersionTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "schema_version_total",
+			Help: "The total number of successfully validated messages, labeled by envelope Version",
+		}, []string{"version"}),
+	}
+
+	registry.MustRegister(
+		metrics.ConsumedMessagesTotal,
+		metrics.ParseErrorsTotal,
+		metrics.StorageWriteErrorsTotal,
+		metrics.StorageWriteDuration,
+		metrics.ConsumerLag,
+		metrics.HTTPRequestDuration,
+		metrics.SchemaVersionTotal,
+	)
+
+	return metrics
+}
+
+// Serve starts a dedicated admin HTTP listener exposing the collectors in
+// Registry at /metrics in the Prometheus exposition format. It blocks
+// until the listener fails or is closed, so callers run it in its own
+// goroutine.
+func (metrics *Metrics) Serve(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(address, mux)
+}
+
+// Instrument wraps handler so every request it serves is recorded in
+// HTTPRequestDuration under the given route label. It is exported so the
+// REST API server can instrument its own routes with the same collector.
+func (metrics *Metrics) Instrument(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(writer, request)
+		metrics.HTTPRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2020 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema validates incoming Kafka messages against a JSON Schema
+// before the consumer trusts their contents, so a malformed Report body is
+// rejected up front instead of corrupting rows or failing deep inside SQL.
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Configuration holds the schema subpackage's own configuration, loaded
+// from the "processing" section of the config file
+type Configuration struct {
+	SchemaPath string
+}
+
+// SchemaError is returned by Validator.Validate when a message does not
+// conform to the configured JSON Schema
+type SchemaError struct {
+	message string
+}
+
+func (e *SchemaError) Error() string {
+	return e.message
+}
+
+// Validator validates raw message payloads against a single loaded JSON
+// Schema
+type Validator struct {
+	schema *gojsonschema.Schema
+}
+
+// envelope picks out the two fields gojsonschema's draft-07 implementation
+// cannot actually check: it has no "format: uuid" checker and never
+// evaluates contentMediaType/contentSchema, so both keywords in
+// message_schema_v1.json are silently ignored. ClusterName and Report are
+// re-validated here in Go instead.
+type envelope struct {
+	ClusterName string `json:"ClusterName"`
+	Report      string `json:"Report"`
+}
+
+// New loads the JSON Schema found at schemaPath and returns a Validator
+// that checks messages against it
+func New(schemaPath string) (*Validator, error) {
+	loader := gojsonschema.NewReferenceLoader("file://" + schemaPath)
+	schema, err := gojsonschema.NewSchema(loader)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{schema: schema}, nil
+}
+
+// Validate checks messageValue against the loaded schema, returning a
+// *SchemaError describing every violation found. A payload that cannot be
+// loaded as JSON at all is reported with gojsonschema's own error instead.
+func (validator *Validator) Validate(messageValue []byte) error {
+	result, err := validator.schema.Validate(gojsonschema.NewBytesLoader(messageValue))
+	if err != nil {
+		return err
+	}
+	if !result.Valid() {
+		violations := make([]string, 0, len(result.Errors()))
+		for _, resultError := range result.Errors() {
+			violations = append(violations, resultError.String())
+		}
+		return &SchemaError{message: strings.Join(violations, "; ")}
+	}
+
+	var parsed envelope
+	if err := json.Unmarshal(messageValue, &parsed); err != nil {
+		return &SchemaError{message: err.Error()}
+	}
+	if _, err := uuid.Parse(parsed.ClusterName); err != nil {
+		return &SchemaError{message: "ClusterName is not a valid UUID: " + err.Error()}
+	}
+	var report map[string]interface{}
+	if err := json.Unmarshal([]byte(parsed.Report), &report); err != nil || report == nil {
+		return &SchemaError{message: "Report is not a JSON object"}
+	}
+	if reports, found := report["reports"]; found {
+		if _, isArray := reports.([]interface{}); !isArray {
+			return &SchemaError{message: "Report field 'reports' is not an array"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2020 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/RedHatInsights/insights-operator-utils/responses"
+	"github.com/RedHatInsights/insights-results-aggregator/metrics"
+	"github.com/RedHatInsights/insights-results-aggregator/storage"
+	"github.com/gorilla/mux"
+)
+
+// Configuration holds the REST API server's own configuration, loaded from
+// the "server" section of the config file
+type Configuration struct {
+	Address   string
+	APIPrefix string
+}
+
+// HTTPServer implements the REST API exposed by this service
+type HTTPServer struct {
+	Configuration Configuration
+	Storage       storage.Storage
+	// Metrics holds the Prometheus collectors this server reports to. It
+	// is nil when no metrics registry was configured, in which case
+	// routes are served uninstrumented.
+	Metrics *metrics.Metrics
+}
+
+// New constructs new implementation of HTTPServer
+func New(configuration Configuration, storage storage.Storage, metrics *metrics.Metrics) HTTPServer {
+	return HTTPServer{
+		Configuration: configuration,
+		Storage:       storage,
+		Metrics:       metrics,
+	}
+}
+
+// Start builds the router and starts serving the REST API. It blocks until
+// the listener is closed or fails.
+func (server HTTPServer) Start() error {
+	router := mux.NewRouter().StrictSlash(true)
+	server.addRoutes(router)
+
+	log.Printf("Starting HTTP server at %s\n", server.Configuration.Address)
+	err := http.ListenAndServe(server.Configuration.Address, router)
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (server HTTPServer) addRoutes(router *mux.Router) {
+	apiPrefix := server.Configuration.APIPrefix
+	server.addRoute(
+		router,
+		apiPrefix+"organizations/{organization}/clusters/{cluster}/report",
+		"report",
+		server.readReportForCluster,
+	).Methods(http.MethodGet)
+}
+
+// addRoute registers handler at path, wrapping it so every request it
+// serves is observed in Metrics.HTTPRequestDuration under the given route
+// label
+func (server HTTPServer) addRoute(
+	router *mux.Router, path string, route string, handler http.HandlerFunc,
+) *mux.Route {
+	var wrapped http.Handler = handler
+	if server.Metrics != nil {
+		wrapped = server.Metrics.Instrument(route, handler)
+	}
+	return router.Handle(path, wrapped)
+}
+
+// readReportForCluster returns the most recently written report for the
+// cluster identified by the organization and cluster name in the URL
+func (server HTTPServer) readReportForCluster(writer http.ResponseWriter, request *http.Request) {
+	organizationID, err := server.readOrganizationID(writer, request)
+	if err != nil {
+		// error response already written by readOrganizationID
+		return
+	}
+	clusterName, err := server.readClusterName(writer, request)
+	if err != nil {
+		// error response already written by readClusterName
+		return
+	}
+
+	report, err := server.Storage.ReadReportForCluster(organizationID, clusterName)
+	if err != nil {
+		log.Println("Error reading report for cluster:", err)
+		responses.SendInternalServerError(writer, err.Error())
+		return
+	}
+	responses.Send(http.StatusOK, writer, report)
+}